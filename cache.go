@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+
+	"github.com/sclevine/sum/sumcache"
+)
+
+// cacheRecord builds the record stored for path's content (or, for a
+// directory entry's header, the name/sysattr/xattr digest folded into
+// sum) so a later run can decide whether it's still valid.
+func (s Sum) cacheRecord(fi os.FileInfo, sys *SysProps, sum []byte) *sumcache.Record {
+	rec := &sumcache.Record{
+		Algorithm: s.Algorithm,
+		Mask:      s.Mask.String(),
+		Size:      fi.Size(),
+		Mode:      uint32(fi.Mode()),
+		Sum:       sum,
+	}
+	if sys != nil {
+		rec.UID, rec.GID = sys.UID, sys.GID
+		rec.Mtime, rec.MtimeNsec = sys.Mtime.Sec, sys.Mtime.Nsec
+		rec.Ctime, rec.CtimeNsec = sys.Ctime.Sec, sys.Ctime.Nsec
+	}
+	if s.Chunk != nil {
+		rec.Chunked = true
+		rec.ChunkBits = s.Chunk.Bits
+		rec.ChunkMin = s.Chunk.Min
+		rec.ChunkMax = s.Chunk.Max
+	}
+	return rec
+}
+
+// cacheValid reports whether rec still describes path as of fi/sys:
+// every field the current Mask covers must be unchanged, along with
+// the algorithm and mask themselves (changing either invalidates the
+// whole cache rather than risk mixing digests across settings).
+func (s Sum) cacheValid(rec *sumcache.Record, fi os.FileInfo, sys *SysProps) bool {
+	if rec.Size != fi.Size() || !s.chunkValid(rec) {
+		return false
+	}
+	return s.statValid(rec, fi.Mode(), sys)
+}
+
+// chunkValid reports whether rec was computed under the same
+// content-defined chunking settings (or lack of them) as s: changing
+// --chunked or its parameters changes a regular file's digest even
+// though its stat is unchanged, so the cache must track chunk mode
+// as part of a Content record's validity.
+func (s Sum) chunkValid(rec *sumcache.Record) bool {
+	if s.Chunk == nil {
+		return !rec.Chunked
+	}
+	return rec.Chunked &&
+		rec.ChunkBits == s.Chunk.Bits &&
+		rec.ChunkMin == s.Chunk.Min &&
+		rec.ChunkMax == s.Chunk.Max
+}
+
+// statValid is the part of cache validity that a content record and a
+// header record both need: the algorithm and mask must match what rec
+// was built from, and path must not have changed since.
+//
+// mtime and ctime are always checked here, regardless of whether
+// Mask.Attr includes AttrMtime/AttrCtime: those bits control which
+// stat fields get folded into the *digest itself*, an orthogonal
+// concern from whether the cache entry is stale. With the default
+// mask (Attr == 0), gating staleness on those same bits meant a file
+// rewritten in place at its original size and mode (the common case:
+// an overwrite, a fixed-width in-place edit, a layer rewritten at the
+// same offset) compared equal on size+mode alone and served a stale
+// digest forever.
+func (s Sum) statValid(rec *sumcache.Record, mode os.FileMode, sys *SysProps) bool {
+	if rec.Algorithm != s.Algorithm || rec.Mask != s.Mask.String() {
+		return false
+	}
+	if rec.Mode != uint32(mode) {
+		return false
+	}
+	if sys == nil {
+		return true
+	}
+	if rec.Mtime != sys.Mtime.Sec || rec.MtimeNsec != sys.Mtime.Nsec {
+		return false
+	}
+	if rec.Ctime != sys.Ctime.Sec || rec.CtimeNsec != sys.Ctime.Nsec {
+		return false
+	}
+	if s.Mask.Attr&AttrUID != 0 && rec.UID != sys.UID {
+		return false
+	}
+	if s.Mask.Attr&AttrGID != 0 && rec.GID != sys.GID {
+		return false
+	}
+	return true
+}
+
+// cacheLookupContent returns the cached digest for path if the cache
+// is enabled, populated, and still valid for fi/sys.
+func (s Sum) cacheLookupContent(path string, fi os.FileInfo, sys *SysProps) ([]byte, bool) {
+	if s.Cache == nil {
+		return nil, false
+	}
+	rec, ok := s.Cache.LookupContent(path)
+	if !ok || !s.cacheValid(rec, fi, sys) {
+		return nil, false
+	}
+	return rec.Sum, true
+}
+
+// cacheStoreContent records digest as path's content sum, if caching
+// is enabled.
+func (s Sum) cacheStoreContent(path string, fi os.FileInfo, sys *SysProps, digest []byte) {
+	if s.Cache == nil {
+		return
+	}
+	// a failed cache write shouldn't fail the run; the next run just
+	// misses and recomputes.
+	_ = s.Cache.StoreContent(path, s.cacheRecord(fi, sys, digest))
+}
+
+// headerRecord builds the record stored for n's Merkle "header": the
+// name, sysattr, and xattr digests a directory entry contributes,
+// which only depend on n's own stat, not its content.
+func (s Sum) headerRecord(n *Node, nameSum, permSum, xattrSum []byte) *sumcache.Record {
+	rec := &sumcache.Record{
+		Algorithm: s.Algorithm,
+		Mask:      s.Mask.String(),
+		Mode:      uint32(n.Mode),
+		NameSum:   nameSum,
+		PermSum:   permSum,
+		Xattr:     xattrSum,
+	}
+	if n.Sys != nil {
+		rec.UID, rec.GID = n.Sys.UID, n.Sys.GID
+		rec.Mtime, rec.MtimeNsec = n.Sys.Mtime.Sec, n.Sys.Mtime.Nsec
+		rec.Ctime, rec.CtimeNsec = n.Sys.Ctime.Sec, n.Sys.Ctime.Nsec
+	}
+	return rec
+}
+
+// cacheLookupHeader returns the cached name/sysattr digests for n if
+// the cache is enabled, populated, and still valid for n's stat.
+func (s Sum) cacheLookupHeader(n *Node) (*sumcache.Record, bool) {
+	if s.Cache == nil {
+		return nil, false
+	}
+	rec, ok := s.Cache.LookupHeader(n.Path)
+	if !ok || !s.statValid(rec, n.Mode, n.Sys) {
+		return nil, false
+	}
+	return rec, true
+}
+
+// cacheStoreHeader records n's name/sysattr/xattr digests, if caching
+// is enabled.
+func (s Sum) cacheStoreHeader(n *Node, nameSum, permSum, xattrSum []byte) {
+	if s.Cache == nil {
+		return
+	}
+	_ = s.Cache.StoreHeader(n.Path, s.headerRecord(n, nameSum, permSum, xattrSum))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ChunkOptions configures content-defined chunking of regular files:
+// instead of hashing a file's bytes in one pass, Sum.hashReader splits
+// it into variable-sized chunks at content-defined cut points, hashes
+// each chunk independently, and combines the chunk digests into a
+// Merkle root. Two runs of the same bytes always cut at the same
+// offsets, so unchanged chunks can be recognized (e.g. via the
+// Sidecar listing) even when surrounding bytes shift. Cache still
+// stores one record per file, not per chunk.
+type ChunkOptions struct {
+	// Bits sets the target average chunk size to 2^Bits bytes: a cut
+	// point is any rolling-hash value whose low Bits bits are zero.
+	Bits uint
+	Min  int
+	Max  int
+	// Sidecar, if true, writes a "<path>.chunks" file listing
+	// (offset, length, digest) for each chunk, one per line, so
+	// downstream tools can do partial re-verification or dedup.
+	Sidecar bool
+}
+
+// hashReaderChunked hashes r as a sequence of content-defined chunks
+// and combines their digests into a Merkle root: each chunk becomes a
+// (length || digest) block, and the blocks are hashed the same way
+// s.merkle hashes a directory's entry blocks, except chunk blocks are
+// never sorted: they stay in file order, since order is part of a
+// file's identity.
+func (s Sum) hashReaderChunked(r io.Reader, path string) ([]byte, error) {
+	opts := s.Chunk
+	mask := uint32(1)<<opts.Bits - 1
+
+	br := bufio.NewReaderSize(r, 64*1024)
+	var bz buzhash
+	buf := make([]byte, 0, opts.Max)
+	var blocks [][]byte
+	var chunks []chunkEntry
+	var offset int64
+
+	emit := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+		digest, err := s.hash(buf)
+		if err != nil {
+			return err
+		}
+		block := binary.LittleEndian.AppendUint64(nil, uint64(len(buf)))
+		block = append(block, digest...)
+		blocks = append(blocks, block)
+		chunks = append(chunks, chunkEntry{offset, int64(len(buf)), digest})
+		offset += int64(len(buf))
+		buf = buf[:0]
+		return nil
+	}
+
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, c)
+		cut := bz.roll(c)
+		atCut := len(buf) >= opts.Min && cut&mask == 0
+		if atCut || len(buf) >= opts.Max {
+			if err := emit(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := emit(); err != nil {
+		return nil, err
+	}
+
+	if opts.Sidecar {
+		if err := writeChunkSidecar(path, chunks); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Plugin != nil {
+		return s.Plugin.Tree(blocks)
+	}
+	h := s.Func()
+	for _, block := range blocks {
+		if _, err := h.Write(block); err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+type chunkEntry struct {
+	Offset, Length int64
+	Sum            []byte
+}
+
+func writeChunkSidecar(path string, chunks []chunkEntry) error {
+	f, err := os.Create(path + ".chunks")
+	if err != nil {
+		return fmt.Errorf("%s: failed to write chunks: %w", path, err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, c := range chunks {
+		if _, err := fmt.Fprintf(w, "%d %d %x\n", c.Offset, c.Length, c.Sum); err != nil {
+			return fmt.Errorf("%s: failed to write chunks: %w", path, err)
+		}
+	}
+	return w.Flush()
+}
+
+// windowSize is the rolling hash window, in bytes: cut decisions only
+// depend on the last windowSize bytes seen, so boundaries don't shift
+// with read buffer size or platform.
+const windowSize = 64
+
+// buzhash is a Buzhash (cyclic polynomial) rolling hash over the last
+// windowSize bytes. Its value is recomputed incrementally as bytes
+// enter and leave the window, so hashing n bytes costs O(n) rather
+// than O(n*windowSize).
+type buzhash struct {
+	window [windowSize]byte
+	pos    int
+	filled int
+	h      uint32
+}
+
+func (b *buzhash) roll(c byte) uint32 {
+	var out byte
+	if b.filled == windowSize {
+		out = b.window[b.pos]
+	} else {
+		b.filled++
+	}
+	b.window[b.pos] = c
+	b.pos = (b.pos + 1) % windowSize
+	b.h = rol32(b.h, 1) ^ rol32(buzhashTable[out], windowSize%32) ^ buzhashTable[c]
+	return b.h
+}
+
+func rol32(x uint32, n uint) uint32 {
+	n %= 32
+	if n == 0 {
+		return x
+	}
+	return x<<n | x>>(32-n)
+}
+
+// buzhashTable maps each byte value to a pseudo-random uint32, derived
+// deterministically (via splitmix64 from a fixed seed) so chunk
+// boundaries are identical across platforms and Go versions without
+// shipping a 256-entry literal table.
+var buzhashTable = newBuzhashTable()
+
+func newBuzhashTable() [256]uint32 {
+	var t [256]uint32
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range t {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		z ^= z >> 31
+		t[i] = uint32(z)
+	}
+	return t
+}
@@ -0,0 +1,124 @@
+// Command plugin is a reference xsum hash plugin. It hashes its input
+// with SHA-256 and supports both the plugin protocols: the original
+// one-shot protocol (exec'd once per call, reading stdin and writing
+// the sum to stdout, with XSUM_PLUGIN_TYPE naming the call) and the
+// streaming protocol (spawned once, speaking length-prefixed frames on
+// stdin/stdout, selected by XSUM_PLUGIN_PROTO=v2 in its environment).
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+)
+
+func main() {
+	log.SetFlags(0)
+	if os.Getenv("XSUM_PLUGIN_PROTO") == "v2" {
+		if err := runStreaming(); err != nil {
+			log.Fatalf("plugin: %s", err)
+		}
+		return
+	}
+	if err := runOnce(); err != nil {
+		log.Fatalf("plugin: %s", err)
+	}
+}
+
+// runOnce implements the v1 protocol: hash stdin and write the digest
+// to stdout. XSUM_PLUGIN_TYPE (metadata, data, or tree) isn't needed
+// here since SHA-256 treats every call the same way.
+func runOnce() error {
+	h := sha256.New()
+	if _, err := io.Copy(h, os.Stdin); err != nil {
+		return err
+	}
+	_, err := os.Stdout.Write(h.Sum(nil))
+	return err
+}
+
+type reqType uint8
+
+const (
+	reqMetadata reqType = iota
+	reqData
+	reqTree
+	reqClose
+)
+
+type status uint8
+
+const (
+	statusOK status = iota
+	statusError
+)
+
+const protoVersion = 2
+
+// runStreaming implements the v2 protocol: a version handshake, then a
+// loop of length-prefixed requests and responses until a close request
+// arrives or stdin closes.
+func runStreaming() error {
+	in := bufio.NewReader(os.Stdin)
+	out := bufio.NewWriter(os.Stdout)
+
+	version, err := in.ReadByte()
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write([]byte{protoVersion}); err != nil {
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	if version != protoVersion {
+		return nil
+	}
+
+	for {
+		var t uint8
+		if err := binary.Read(in, binary.LittleEndian, &t); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var length uint64
+		if err := binary.Read(in, binary.LittleEndian, &length); err != nil {
+			return err
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(in, payload); err != nil {
+			return err
+		}
+		if reqType(t) == reqClose {
+			return nil
+		}
+
+		h := sha256.New()
+		h.Write(payload)
+		sum := h.Sum(nil)
+
+		if err := writeFrame(out, uint8(statusOK), sum); err != nil {
+			return err
+		}
+		if err := out.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+func writeFrame(w io.Writer, s uint8, payload []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, s); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(payload))); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
@@ -13,16 +13,25 @@ import (
 	"runtime"
 	"sort"
 	"strings"
-	"sync"
 
 	"github.com/jessevdk/go-flags"
 	"golang.org/x/sync/semaphore"
+
+	"github.com/sclevine/sum/sum"
 )
 
 type Options struct {
 	Algorithm string `short:"a" long:"algorithm" default:"sha256" description:"Use hashing algorithm"`
 	Check     bool   `short:"c" long:"check" description:"Validate checksums"`
 	Mask      string `short:"m" long:"mask" default:"0000" description:"Apply mask"`
+	CacheDir  string `long:"cache-dir" description:"Cache computed sums in this directory"`
+	Chunked   bool   `long:"chunked" description:"Hash regular files as content-defined chunks"`
+	ChunkBits uint   `long:"chunk-bits" default:"17" description:"Target chunk size as 2^n bytes"`
+	ChunkMin  int    `long:"chunk-min" default:"65536" description:"Minimum chunk size in bytes"`
+	ChunkMax  int    `long:"chunk-max" default:"1048576" description:"Maximum chunk size in bytes"`
+	Chunks    bool   `long:"chunks" description:"Write a .chunks sidecar file alongside each chunked file"`
+	Plugin    string `long:"plugin" description:"Hash using the plugin at this path instead of Algorithm (long-lived if it speaks the streaming protocol)"`
+	Output    string `long:"output" default:"text" description:"Output format (text, oci)"`
 	Args      struct {
 		Paths []string `required:"1"`
 	} `positional-args:"yes"`
@@ -42,12 +51,44 @@ func main() {
 	}
 
 	mask := NewMaskString(opts.Mask)
-	hf := ParseHash(opts.Algorithm)
-	sum := Sum{Func: hf, Mask: mask}
-	if hf == nil {
-		log.Fatalf("Invalid algorithm `%s'", opts.Algorithm)
+	var hf HashFunc
+	var plugin sum.Hash
+	if opts.Plugin != "" {
+		plugin = sum.NewHashPluginAuto(opts.Algorithm, opts.Plugin)
+		if closer, ok := plugin.(io.Closer); ok {
+			defer closer.Close()
+		}
+	} else {
+		hf = ParseHash(opts.Algorithm)
+		if hf == nil {
+			log.Fatalf("Invalid algorithm `%s'", opts.Algorithm)
+		}
+	}
+	s := Sum{Func: hf, Plugin: plugin, Mask: mask, Algorithm: opts.Algorithm}
+	if opts.Chunked {
+		s.Chunk = &ChunkOptions{
+			Bits:    opts.ChunkBits,
+			Min:     opts.ChunkMin,
+			Max:     opts.ChunkMax,
+			Sidecar: opts.Chunks,
+		}
 	}
-	next := sum.Sum(opts.Args.Paths)
+	if opts.CacheDir != "" {
+		cache, err := sum.NewCacheContext(filepath.Join(opts.CacheDir, "xsum.cache"))
+		if err != nil {
+			log.Fatalf("xsum: failed to open cache: %s", err)
+		}
+		defer cache.Close()
+		s.Cache = cache
+	}
+	if opts.Output == "oci" {
+		if err := outputOCI(s, opts.Args.Paths, opts.Algorithm, mask.String()); err != nil {
+			log.Fatalf("xsum: %s", err)
+		}
+		return
+	}
+
+	next := s.TreeSum(opts.Args.Paths)
 	for n, err := next(); err != ErrEmpty; n, err = next() {
 		if err != nil {
 			log.Printf("xsum: %s", err)
@@ -78,143 +119,114 @@ type Node struct {
 type Sum struct {
 	Func HashFunc
 	Mask Mask
-}
 
-func (s Sum) Sum(paths []string) func() (*Node, error) {
-	queue := newPQ(len(paths))
-	for i, path := range paths {
-		i, path := i, path
-		go func() {
-			n, err := s.walk(filepath.Clean(path), false)
-			queue.add(i, n, err)
-		}()
-	}
-	return queue.next
-}
+	// Plugin, if set, hashes through it instead of Func, bypassing the
+	// stdlib hash.Hash abstraction entirely (Func stays unset in this
+	// case). It's the only way to drive a plugin that reports errors,
+	// since hash.Hash.Sum can't return one.
+	Plugin sum.Hash
 
-func (s Sum) walk(path string, subdir bool) (*Node, error) {
-	lock()
-	rs := runSwitch(true)
-	defer rs.Do(release)
+	// Algorithm names Func (or Plugin) for cache validation; it's
+	// informational only and never affects the computed sum.
+	Algorithm string
+	// Cache, if set, lets Tree/TreeSum reuse sums from a previous run
+	// instead of rehashing paths whose stat metadata hasn't changed.
+	Cache *sum.CacheContext
+	// Chunk, if set, hashes regular files as content-defined chunks
+	// instead of in one pass. Directories and symlinks are unaffected.
+	Chunk *ChunkOptions
+}
 
-	fi, err := os.Lstat(path)
-	if os.IsNotExist(err) {
-		return nil, pathNewErr("does not exist", path, subdir)
-	}
+func (s Sum) merkle(nodes []*Node) ([]byte, error) {
+	_, blocks, err := s.merkleOrder(nodes)
 	if err != nil {
-		return nil, pathErr("stat", path, subdir, err)
+		return nil, err
 	}
-	switch {
-	case fi.IsDir():
-		names, err := readDirUnordered(path)
-		if err != nil {
-			return nil, pathErr("read dir", path, subdir, err)
-		}
-		release()
-		rs.Set(false)
-		nodes, err := s.dir(path, names)
-		if err != nil {
-			if subdir {
-				return nil, err
-			}
-			return nil, fmt.Errorf("%s: %w", path, err)
-		}
-		lock()
-		rs.Set(true)
-		sum, err := s.merkle(nodes)
-		if err != nil {
-			return nil, pathErr("hash", path, subdir, err)
-		}
-		return &Node{path, sum, fi.Mode(), getSysProps(fi)}, nil
-
-	case fi.Mode().IsRegular() || (!subdir && fi.Mode()&os.ModeSymlink != 0):
-		f, err := os.Open(path)
-		if err != nil {
-			return nil, pathErr("open", path, subdir, err)
-		}
-		defer f.Close()
-		sum, err := s.hashReader(f)
-		if err != nil {
-			return nil, pathErr("hash", path, subdir, err)
-		}
-		return &Node{path, sum, fi.Mode(), getSysProps(fi)}, nil
+	return s.digestBlocks(blocks)
+}
 
-	case fi.Mode()&os.ModeSymlink != 0:
-		link, err := os.Readlink(path)
-		if err != nil {
-			return nil, pathErr("read link", path, subdir, err)
-		}
-		sum, err := s.hash([]byte(link))
-		if err != nil {
-			return nil, pathErr("hash", path, subdir, err)
+// digestBlocks combines already-ordered Merkle blocks into their
+// parent's digest, split out of merkle so a caller that also needs the
+// sorted order merkleOrder produced (e.g. an OCI manifest's layer
+// list) can get both from a single merkleOrder call instead of hashing
+// nodes twice.
+func (s Sum) digestBlocks(blocks [][]byte) ([]byte, error) {
+	if s.Plugin != nil {
+		return s.Plugin.Tree(blocks)
+	}
+	h := s.Func()
+	for _, block := range blocks {
+		if _, err := h.Write(block); err != nil {
+			return nil, err
 		}
-		return &Node{path, sum, fi.Mode(), getSysProps(fi)}, nil
 	}
-	return nil, pathErr("hash", path, subdir, ErrSpecialFile)
+	return h.Sum(nil), nil
 }
 
-func (s Sum) dir(path string, names []string) ([]*Node, error) {
-	var wg sync.WaitGroup
-	wg.Add(len(names))
-	errC := make(chan error)
-	go func() {
-		wg.Wait()
-		close(errC) // safe, no more errors sent
-	}()
-	nodes := make([]*Node, len(names))
-	for i, name := range names {
-		i, path := i, filepath.Join(path, name)
-		go func() {
-			var err error
-			nodes[i], err = s.walk(path, true)
-			if err != nil {
-				errC <- err
-			}
-			wg.Done()
-		}()
-	}
-	for err := range errC {
-		// error from walk has adequate context
-		return nil, err
+// merkleOrder returns nodes and their Merkle blocks (nameSum || n.Sum
+// || permSum || xattrSum), both reordered into the sorted order merkle
+// combines them in. A caller that needs to present nodes alongside the
+// digest they produced (an OCI manifest's layer list) can use this to
+// match that order exactly instead of guessing at a different one
+// (e.g. by name).
+func (s Sum) merkleOrder(nodes []*Node) ([]*Node, [][]byte, error) {
+	type pair struct {
+		node  *Node
+		block []byte
 	}
-	return nodes, nil
-}
-
-func (s Sum) merkle(nodes []*Node) ([]byte, error) {
-	blocks := make([][]byte, 0, len(nodes))
+	pairs := make([]pair, 0, len(nodes))
 	for _, n := range nodes {
-		nameSum, err := s.hash([]byte(filepath.Base(n.Path)))
-		if err != nil {
-			return nil, err
-		}
-		permSum, err := s.sysattrHash(n)
+		nameSum, permSum, xattrSum, err := s.headerHash(n)
 		if err != nil {
-			return nil, err
-		}
-		xattrSum, err := s.xattrHash(n)
-		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		buf := bytes.NewBuffer(make([]byte, 0, len(n.Sum)*4))
 		buf.Write(nameSum)
 		buf.Write(n.Sum)
 		buf.Write(permSum)
 		buf.Write(xattrSum)
-		blocks = append(blocks, buf.Bytes())
+		pairs = append(pairs, pair{n, buf.Bytes()})
 	}
-	sort.Slice(blocks, func(i, j int) bool {
-		return bytes.Compare(blocks[i], blocks[j]) < 0
+	sort.Slice(pairs, func(i, j int) bool {
+		return bytes.Compare(pairs[i].block, pairs[j].block) < 0
 	})
-	h := s.Func()
-	for _, block := range blocks {
-		if _, err := h.Write(block); err != nil {
-			return nil, err
-		}
+	nodesOut := make([]*Node, len(pairs))
+	blocks := make([][]byte, len(pairs))
+	for i, p := range pairs {
+		nodesOut[i] = p.node
+		blocks[i] = p.block
 	}
-	return h.Sum(nil), nil
+	return nodesOut, blocks, nil
+}
+
+// headerHash returns n's name, sysattr, and xattr digests, the three
+// components of the Merkle "header" its directory entry contributes,
+// reusing Sum.Cache's header record when n's stat hasn't changed
+// since it was last computed.
+func (s Sum) headerHash(n *Node) (nameSum, permSum, xattrSum []byte, err error) {
+	if rec, ok := s.cacheLookupHeader(n); ok {
+		return rec.NameSum, rec.PermSum, rec.Xattr, nil
+	}
+	nameSum, err = s.hash([]byte(filepath.Base(n.Path)))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	permSum, err = s.sysattrHash(n)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	xattrSum, err = s.xattrHash(n)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	s.cacheStoreHeader(n, nameSum, permSum, xattrSum)
+	return nameSum, permSum, xattrSum, nil
 }
 
 func (s Sum) hash(b []byte) ([]byte, error) {
+	if s.Plugin != nil {
+		return s.Plugin.Metadata(b)
+	}
 	h := s.Func()
 	if _, err := h.Write(b); err != nil {
 		return nil, err
@@ -223,6 +235,9 @@ func (s Sum) hash(b []byte) ([]byte, error) {
 }
 
 func (s Sum) hashReader(r io.Reader) ([]byte, error) {
+	if s.Plugin != nil {
+		return s.Plugin.Data(r)
+	}
 	h := s.Func()
 	if _, err := io.Copy(h, r); err != nil {
 		return nil, err
@@ -286,18 +301,6 @@ func (s Sum) xattrHash(n *Node) ([]byte, error) {
 	return nil, nil
 }
 
-type runSwitch bool
-
-func (rs *runSwitch) Do(f func()) {
-	if *rs {
-		f()
-	}
-}
-
-func (rs *runSwitch) Set(v bool) {
-	*rs = runSwitch(v)
-}
-
 func pathErr(verb, path string, subdir bool, err error) error {
 	var msg string
 	pErr := &os.PathError{}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/sclevine/sum/sum"
+)
+
+// walkTop computes path's sum via the same lazy *sum.Node tree as
+// TreeSum, but for a directory also returns its immediate children,
+// letting the OCI formatter describe one extra level (a manifest's
+// layers) without re-walking the whole subtree.
+func (s Sum) walkTop(path string) (*Node, []*Node, error) {
+	root, err := s.treeNode(path, false, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi := root.Info()
+	if !fi.IsDir() {
+		digest, err := root.Hash()
+		if err != nil {
+			return nil, nil, err
+		}
+		return &Node{path, digest, fi.Mode(), getSysProps(fi)}, nil, nil
+	}
+	entries := make([]*Node, len(root.Children()))
+	for i, c := range root.Children() {
+		cDigest, err := c.Hash()
+		if err != nil {
+			return nil, nil, err
+		}
+		cFi := c.Info()
+		entries[i] = &Node{c.Path(), cDigest, cFi.Mode(), getSysProps(cFi)}
+	}
+	// Compute the order and the digest from the same merkleOrder pass,
+	// rather than calling root.Hash() (which would redo this exact
+	// header-hashing work inside treeNode's hashFn) and then separately
+	// recomputing the order: the manifest's layer list ends up in
+	// exactly the order that produced the digest, at the cost of one
+	// header hash per child, not two.
+	children, blocks, err := s.merkleOrder(entries)
+	if err != nil {
+		return nil, nil, err
+	}
+	digest, err := s.digestBlocks(blocks)
+	if err != nil {
+		return nil, nil, pathErr("hash", path, false, err)
+	}
+	return &Node{path, digest, fi.Mode(), getSysProps(fi)}, children, nil
+}
+
+// ociEntry converts a Node (and, for a directory, its immediate
+// children) into the generic sum.Entry the OCI formatter consumes.
+func ociEntry(n *Node, children []*Node, algorithm, maskStr string) sum.Entry {
+	e := sum.Entry{
+		Path:      n.Path,
+		Algorithm: algorithm,
+		Mask:      maskStr,
+		Sum:       n.Sum,
+		IsDir:     n.Mode&os.ModeDir != 0,
+	}
+	if e.IsDir {
+		e.Children = make([]sum.Entry, len(children))
+		for i, c := range children {
+			ce := sum.Entry{
+				Path:      c.Path,
+				Algorithm: algorithm,
+				Sum:       c.Sum,
+				IsDir:     c.Mode&os.ModeDir != 0,
+			}
+			if !ce.IsDir {
+				if fi, err := os.Lstat(c.Path); err == nil {
+					ce.Size = fi.Size()
+				}
+			}
+			e.Children[i] = ce
+		}
+		return e
+	}
+	if fi, err := os.Lstat(n.Path); err == nil {
+		e.Size = fi.Size()
+	}
+	return e
+}
+
+// outputOCI hashes each of paths and writes one OCI descriptor
+// document per path to stdout.
+func outputOCI(s Sum, paths []string, algorithm, maskStr string) error {
+	formatter := sum.NewOCIFormatter()
+	for _, path := range paths {
+		n, children, err := s.walkTop(filepath.Clean(path))
+		if err != nil {
+			return err
+		}
+		if err := formatter.Format(os.Stdout, ociEntry(n, children, algorithm, maskStr)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
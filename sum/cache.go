@@ -0,0 +1,48 @@
+package sum
+
+import "github.com/sclevine/sum/sumcache"
+
+// CacheContext lets xsum's tree walk reuse Merkle sums computed by a previous
+// run instead of rehashing files and directories whose stat metadata
+// hasn't changed. It wraps a sumcache.Cache so the main package never
+// needs to know about the cache's on-disk format.
+type CacheContext struct {
+	cache *sumcache.Cache
+}
+
+// NewCacheContext opens (or creates) the persistent cache log at path.
+// An empty path yields a cache that's never written to disk, useful
+// for sharing lookups within a single run without persisting them.
+func NewCacheContext(path string) (*CacheContext, error) {
+	c, err := sumcache.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &CacheContext{cache: c}, nil
+}
+
+// LookupContent returns the cached recursive digest for path, if any.
+func (c *CacheContext) LookupContent(path string) (*sumcache.Record, bool) {
+	return c.cache.Lookup(path, sumcache.Content)
+}
+
+// LookupHeader returns the cached name/sysattr/xattr digest for path,
+// if any.
+func (c *CacheContext) LookupHeader(path string) (*sumcache.Record, bool) {
+	return c.cache.Lookup(path, sumcache.Header)
+}
+
+// StoreContent caches rec as path's recursive digest.
+func (c *CacheContext) StoreContent(path string, rec *sumcache.Record) error {
+	return c.cache.Insert(path, sumcache.Content, rec)
+}
+
+// StoreHeader caches rec as path's name/sysattr/xattr digest.
+func (c *CacheContext) StoreHeader(path string, rec *sumcache.Record) error {
+	return c.cache.Insert(path, sumcache.Header, rec)
+}
+
+// Close flushes the cache to disk, if it's persistent.
+func (c *CacheContext) Close() error {
+	return c.cache.Close()
+}
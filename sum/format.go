@@ -0,0 +1,24 @@
+package sum
+
+import "io"
+
+// Entry describes one node of a hashed tree for output formatting,
+// independent of how the tree was walked or hashed. Children is
+// populated only for entries that were expanded one level deep (xsum
+// only needs immediate children to build an OCI manifest's layer
+// list, not the whole subtree).
+type Entry struct {
+	Path      string
+	Algorithm string
+	Mask      string
+	Sum       []byte
+	Size      int64
+	IsDir     bool
+	Children  []Entry
+}
+
+// Formatter renders a computed Entry to w in a particular
+// serialization.
+type Formatter interface {
+	Format(w io.Writer, e Entry) error
+}
@@ -0,0 +1,115 @@
+package sum
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Descriptor is an OCI content descriptor: a typed, sized, digestible
+// reference to content, matching the shape of
+// github.com/opencontainers/image-spec's Descriptor.
+type Descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+const (
+	MediaTypeFile     = "application/vnd.xsum.file.v1"
+	MediaTypeConfig   = "application/vnd.xsum.dir.config.v1+json"
+	MediaTypeManifest = "application/vnd.xsum.dir.manifest.v1+json"
+)
+
+// manifest mirrors an OCI image manifest: a config descriptor plus an
+// ordered list of layer descriptors.
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    Descriptor   `json:"config"`
+	Layers    []Descriptor `json:"layers"`
+}
+
+type ociFormatter struct{}
+
+// NewOCIFormatter returns a Formatter that emits an OCI content
+// descriptor for a file, or a config+layers manifest for a directory,
+// so a directory's Merkle tree can be pinned and consumed the same way
+// OCI-aware tooling pins image layers, without changing how the
+// underlying sums are computed.
+func NewOCIFormatter() Formatter {
+	return ociFormatter{}
+}
+
+func (ociFormatter) Format(w io.Writer, e Entry) error {
+	v, err := ociDescribe(e)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// ociConfig is the JSON blob a directory manifest's config descriptor
+// digests: enough of e's identity (path and hashing settings) that two
+// manifests with identical layers but different Algorithm/Mask don't
+// collide on the same config digest.
+type ociConfig struct {
+	Path      string `json:"path"`
+	Algorithm string `json:"algorithm"`
+	Mask      string `json:"mask"`
+}
+
+func ociDescribe(e Entry) (interface{}, error) {
+	if !e.IsDir {
+		return Descriptor{
+			MediaType: MediaTypeFile,
+			Digest:    ociDigest(e.Algorithm, e.Sum),
+			Size:      e.Size,
+		}, nil
+	}
+	layers := make([]Descriptor, 0, len(e.Children))
+	for _, c := range e.Children {
+		mt := MediaTypeFile
+		if c.IsDir {
+			mt = MediaTypeManifest
+		}
+		layers = append(layers, Descriptor{
+			MediaType: mt,
+			Digest:    ociDigest(c.Algorithm, c.Sum),
+			Size:      c.Size,
+		})
+	}
+	configBlob, err := json.Marshal(ociConfig{Path: e.Path, Algorithm: e.Algorithm, Mask: e.Mask})
+	if err != nil {
+		return nil, err
+	}
+	configSum := sha256.Sum256(configBlob)
+	return manifest{
+		MediaType: MediaTypeManifest,
+		Config: Descriptor{
+			MediaType: MediaTypeConfig,
+			Digest:    fmt.Sprintf("sha256:%x", configSum),
+			Size:      int64(len(configBlob)),
+		},
+		Layers: layers,
+	}, nil
+}
+
+// ociDigest formats sum as an OCI "algorithm:hex" digest string.
+// Algorithms outside the OCI spec (e.g. hash plugins) are registered
+// under an "xsum+" extension prefix so every digest stays
+// self-describing.
+func ociDigest(algorithm string, sum []byte) string {
+	return fmt.Sprintf("%s:%x", ociAlgorithm(algorithm), sum)
+}
+
+func ociAlgorithm(name string) string {
+	switch name {
+	case "sha256", "sha512":
+		return name
+	default:
+		return "xsum+" + name
+	}
+}
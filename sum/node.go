@@ -0,0 +1,54 @@
+package sum
+
+import (
+	"os"
+	"sync"
+)
+
+// Node is a node in a lazily-hashed Merkle tree: Hash computes and
+// memoizes its digest on demand, recursing into Children as needed, so
+// a caller that only enumerates, filters, or serializes the tree never
+// pays to hash what it doesn't need. This mirrors the node pattern in
+// go-git's filesystem merkletrie.
+type Node struct {
+	path     string
+	info     os.FileInfo
+	children []*Node
+	hash     func() ([]byte, error)
+
+	once sync.Once
+	sum  []byte
+	err  error
+}
+
+// NewNode constructs a Node for path. hash is called at most once, the
+// first time Hash is called, and its result is memoized for every
+// later call.
+func NewNode(path string, info os.FileInfo, children []*Node, hash func() ([]byte, error)) *Node {
+	return &Node{path: path, info: info, children: children, hash: hash}
+}
+
+// Path returns the node's filesystem path.
+func (n *Node) Path() string {
+	return n.path
+}
+
+// Info returns the node's os.Lstat result.
+func (n *Node) Info() os.FileInfo {
+	return n.info
+}
+
+// Children returns the node's immediate children, or nil for a leaf.
+func (n *Node) Children() []*Node {
+	return n.children
+}
+
+// Hash computes (or returns the memoized) digest for the node. For a
+// directory node, this recursively computes (and memoizes) every
+// child's digest first.
+func (n *Node) Hash() ([]byte, error) {
+	n.once.Do(func() {
+		n.sum, n.err = n.hash()
+	})
+	return n.sum, n.err
+}
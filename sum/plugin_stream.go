@@ -0,0 +1,288 @@
+package sum
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// pluginProtoVersion is the streaming protocol version this package
+// speaks. A v1 plugin (built for hashPlugin's one-shot exec-per-call
+// protocol) ignores XSUM_PLUGIN_PROTO and never answers the handshake,
+// so NewHashPluginAuto's probe falls back to the one-shot protocol for
+// it, which is how v1 plugins keep working unmodified.
+const pluginProtoVersion = 2
+
+type pluginReqType uint8
+
+const (
+	reqMetadata pluginReqType = iota
+	reqData
+	reqTree
+	reqClose
+)
+
+type pluginStatus uint8
+
+const (
+	statusOK pluginStatus = iota
+	statusError
+)
+
+// probeHandshakeTimeout bounds how long NewHashPluginAuto waits for a
+// v2 handshake reply before assuming the plugin only speaks the older
+// v1 one-shot protocol.
+const probeHandshakeTimeout = 500 * time.Millisecond
+
+// NewHashPluginAuto returns a Hash backed by path, automatically
+// detecting whether it's a v2 streaming plugin (NewHashPluginStreaming)
+// or an older v1 one-shot plugin (NewHashPlugin). The v2 handshake is
+// tried against a disposable, throwaway process rather than one of
+// NewHashPluginStreaming's pooled long-lived processes: a v1 plugin
+// has no concept of the handshake and would read the stray version
+// byte as the start of its next one-shot call's stdin, corrupting it.
+func NewHashPluginAuto(name, path string) Hash {
+	if probePluginV2(path) {
+		return NewHashPluginStreaming(name, path)
+	}
+	return NewHashPlugin(name, path)
+}
+
+// probePluginV2 reports whether path's plugin acknowledges the v2
+// streaming handshake within probeHandshakeTimeout. A v1 plugin never
+// sends a version byte back, so timeout, EOF, and a version mismatch
+// are all treated alike as "not v2, fall back to the one-shot
+// protocol."
+func probePluginV2(path string) bool {
+	cmd := exec.Command(path)
+	cmd.Env = append(os.Environ(), "XSUM_PLUGIN_PROTO=v2")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return false
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return false
+	}
+	if err := cmd.Start(); err != nil {
+		return false
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	if _, err := stdin.Write([]byte{pluginProtoVersion}); err != nil {
+		return false
+	}
+
+	versionC := make(chan byte, 1)
+	go func() {
+		var b [1]byte
+		if _, err := io.ReadFull(stdout, b[:]); err == nil {
+			versionC <- b[0]
+		}
+	}()
+
+	select {
+	case version := <-versionC:
+		return version == pluginProtoVersion
+	case <-time.After(probeHandshakeTimeout):
+		return false
+	}
+}
+
+// NewHashPluginStreaming returns a Hash backed by a pool of long-lived
+// plugin processes speaking a length-prefixed request/response
+// protocol on stdin/stdout, instead of forking the plugin binary once
+// per call. Each request is a uint8 type, a uint64 length, and the
+// payload; each response is a uint8 status, a uint64 length, and the
+// payload (or an error message when status is non-zero). The pool is
+// sized to runtime.NumCPU() so concurrent callers aren't serialized
+// behind a single process.
+//
+// Callers that want pooled processes to exit cleanly can type-assert
+// the result to io.Closer.
+func NewHashPluginStreaming(name, path string) Hash {
+	return &hashPluginStream{name: name, path: path, size: runtime.NumCPU()}
+}
+
+type hashPluginStream struct {
+	name, path string
+	size       int
+
+	once sync.Once
+	pool chan *pluginProc
+}
+
+func (h *hashPluginStream) String() string {
+	return h.name
+}
+
+func (h *hashPluginStream) Metadata(b []byte) ([]byte, error) {
+	return h.call(reqMetadata, b)
+}
+
+func (h *hashPluginStream) Data(r io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return h.call(reqData, b)
+}
+
+func (h *hashPluginStream) Tree(bs [][]byte) ([]byte, error) {
+	var buf []byte
+	for _, b := range bs {
+		buf = append(buf, b...)
+	}
+	return h.call(reqTree, buf)
+}
+
+// Close sends a close request to and waits for every pooled process.
+func (h *hashPluginStream) Close() error {
+	h.start()
+	var firstErr error
+	for i := 0; i < h.size; i++ {
+		p := <-h.pool
+		if err := p.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (h *hashPluginStream) start() {
+	h.once.Do(func() {
+		h.pool = make(chan *pluginProc, h.size)
+		for i := 0; i < h.size; i++ {
+			h.pool <- newPluginProc(h.path)
+		}
+	})
+}
+
+func (h *hashPluginStream) call(t pluginReqType, payload []byte) ([]byte, error) {
+	h.start()
+	p := <-h.pool
+	defer func() { h.pool <- p }()
+	return p.call(t, payload)
+}
+
+// pluginProc wraps one long-lived plugin process. The process and its
+// version handshake are started lazily, on first use, so a plugin
+// that's never called never forks.
+type pluginProc struct {
+	path string
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	err    error
+}
+
+func newPluginProc(path string) *pluginProc {
+	return &pluginProc{path: path}
+}
+
+func (p *pluginProc) ensureStarted() error {
+	if p.cmd != nil || p.err != nil {
+		return p.err
+	}
+	cmd := exec.Command(p.path)
+	cmd.Env = append(os.Environ(), "XSUM_PLUGIN_PROTO=v2")
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		p.err = err
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		p.err = err
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		p.err = err
+		return err
+	}
+	r := bufio.NewReader(stdout)
+	if _, err := stdin.Write([]byte{pluginProtoVersion}); err != nil {
+		p.err = err
+		return err
+	}
+	version, err := r.ReadByte()
+	if err != nil {
+		p.err = fmt.Errorf("plugin handshake failed: %w", err)
+		return p.err
+	}
+	if version != pluginProtoVersion {
+		p.err = fmt.Errorf("plugin speaks unsupported protocol version %d", version)
+		return p.err
+	}
+	p.cmd, p.stdin, p.stdout = cmd, stdin, r
+	return nil
+}
+
+func (p *pluginProc) call(t pluginReqType, payload []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.ensureStarted(); err != nil {
+		return nil, err
+	}
+	if err := writeFrame(p.stdin, uint8(t), payload); err != nil {
+		return nil, fmt.Errorf("plugin write: %w", err)
+	}
+	status, resp, err := readFrame(p.stdout)
+	if err != nil {
+		return nil, fmt.Errorf("plugin read: %w", err)
+	}
+	if pluginStatus(status) == statusError {
+		return nil, fmt.Errorf("plugin error: %s", resp)
+	}
+	return resp, nil
+}
+
+func (p *pluginProc) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd == nil {
+		return nil
+	}
+	_ = writeFrame(p.stdin, uint8(reqClose), nil)
+	p.stdin.Close()
+	return p.cmd.Wait()
+}
+
+func writeFrame(w io.Writer, t uint8, payload []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, t); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(payload))); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readFrame(r *bufio.Reader) (uint8, []byte, error) {
+	var status uint8
+	if err := binary.Read(r, binary.LittleEndian, &status); err != nil {
+		return 0, nil, err
+	}
+	var length uint64
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return status, payload, nil
+}
@@ -0,0 +1,100 @@
+package sumcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// logEntry is the on-disk (and in-memory replay) representation of one
+// cache write. Fields must be exported for gob to encode them.
+type logEntry struct {
+	Key string
+	Rec *Record
+}
+
+// log is a single append-only file of checksummed records: each record
+// is a uint32 payload length, a uint32 CRC-32 of the payload, and the
+// gob-encoded payload itself. A checksum per record means a partial
+// write from a killed process is detected and dropped on the next
+// read, rather than corrupting the whole cache.
+type log struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func openLog(path string) (*log, []logEntry, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open cache: %w", err)
+	}
+	entries, err := readLog(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("read cache: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("seek cache: %w", err)
+	}
+	return &log{f: f, w: bufio.NewWriter(f)}, entries, nil
+}
+
+// readLog replays every well-formed record from the start of f. A
+// truncated or corrupt trailing record (the signature of a write that
+// was interrupted mid-append) stops the replay rather than failing it.
+func readLog(f *os.File) ([]logEntry, error) {
+	r := bufio.NewReader(f)
+	var entries []logEntry
+	for {
+		var length, checksum uint32
+		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+			return entries, nil
+		}
+		if err := binary.Read(r, binary.LittleEndian, &checksum); err != nil {
+			return entries, nil
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return entries, nil
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return entries, nil
+		}
+		var e logEntry
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&e); err != nil {
+			return entries, nil
+		}
+		entries = append(entries, e)
+	}
+}
+
+func (l *log) append(key string, rec *Record) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(logEntry{Key: key, Rec: rec}); err != nil {
+		return err
+	}
+	payload := buf.Bytes()
+	if err := binary.Write(l.w, binary.LittleEndian, uint32(len(payload))); err != nil {
+		return err
+	}
+	if err := binary.Write(l.w, binary.LittleEndian, crc32.ChecksumIEEE(payload)); err != nil {
+		return err
+	}
+	if _, err := l.w.Write(payload); err != nil {
+		return err
+	}
+	return l.w.Flush()
+}
+
+func (l *log) Close() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,128 @@
+package sumcache
+
+import "strings"
+
+// tree is an immutable, path-compressed radix tree keyed by byte
+// string. insert returns a new tree that shares every untouched
+// subtree with the receiver, so a reader holding an older tree value
+// never observes a write in progress.
+type tree struct {
+	root *node
+}
+
+type node struct {
+	prefix string
+	rec    *Record
+	edges  []*node // sorted by edges[i].prefix[0]
+}
+
+func newTree() *tree {
+	return &tree{root: &node{}}
+}
+
+func (t *tree) get(key string) (*Record, bool) {
+	n := t.root
+	for {
+		if key == "" {
+			if n.rec != nil {
+				return n.rec, true
+			}
+			return nil, false
+		}
+		e := n.edge(key[0])
+		if e == nil || !strings.HasPrefix(key, e.prefix) {
+			return nil, false
+		}
+		key = key[len(e.prefix):]
+		n = e
+	}
+}
+
+func (t *tree) insert(key string, rec *Record) *tree {
+	return &tree{root: t.root.insert(key, rec)}
+}
+
+// insert returns a new node reflecting key=rec, copying only the
+// nodes on the path to the insertion point.
+func (n *node) insert(key string, rec *Record) *node {
+	if key == "" {
+		clone := *n
+		clone.rec = rec
+		return &clone
+	}
+
+	i := n.indexOf(key[0])
+	if i < 0 {
+		clone := *n
+		clone.edges = append(append([]*node{}, n.edges...), &node{prefix: key, rec: rec})
+		clone.sortEdges()
+		return &clone
+	}
+
+	e := n.edges[i]
+	common := commonPrefixLen(e.prefix, key)
+	clone := *n
+	clone.edges = append([]*node{}, n.edges...)
+
+	switch {
+	case common == len(e.prefix):
+		// key extends past this edge; recurse into it.
+		clone.edges[i] = e.insert(key[common:], rec)
+	case common == len(key):
+		// key ends partway through this edge; split it and hang the
+		// remainder of the existing edge off the new node.
+		split := &node{prefix: key, rec: rec, edges: []*node{{
+			prefix: e.prefix[common:],
+			rec:    e.rec,
+			edges:  e.edges,
+		}}}
+		clone.edges[i] = split
+	default:
+		// key and the edge diverge partway through; split into a
+		// shared prefix node with two children.
+		split := &node{prefix: e.prefix[:common], edges: []*node{
+			{prefix: e.prefix[common:], rec: e.rec, edges: e.edges},
+			{prefix: key[common:], rec: rec},
+		}}
+		split.sortEdges()
+		clone.edges[i] = split
+	}
+	return &clone
+}
+
+func (n *node) edge(b byte) *node {
+	if i := n.indexOf(b); i >= 0 {
+		return n.edges[i]
+	}
+	return nil
+}
+
+func (n *node) indexOf(b byte) int {
+	for i, e := range n.edges {
+		if e.prefix[0] == b {
+			return i
+		}
+	}
+	return -1
+}
+
+func (n *node) sortEdges() {
+	for i := 1; i < len(n.edges); i++ {
+		for j := i; j > 0 && n.edges[j-1].prefix[0] > n.edges[j].prefix[0]; j-- {
+			n.edges[j-1], n.edges[j] = n.edges[j], n.edges[j-1]
+		}
+	}
+}
+
+func commonPrefixLen(a, b string) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
@@ -0,0 +1,149 @@
+// Package sumcache caches computed Merkle sums across xsum runs, keyed
+// by cleaned absolute path plus the stat metadata that was live when
+// the sum was taken. It's modeled on the content-hash cache used by
+// BuildKit: an immutable, path-compressed radix tree holds the entries
+// so readers never observe a partially-written update, and an optional
+// append-only log makes the tree durable across process restarts.
+package sumcache
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Kind distinguishes the two records a directory entry contributes to
+// its parent's Merkle computation: the cheap "header" (name, sysattr,
+// and xattr digests) and the expensive recursive "content" digest.
+// Files and symlinks use both too: a Header record is stored for any
+// entry that's combined into a parent directory's Merkle digest.
+type Kind int
+
+const (
+	Content Kind = iota
+	Header
+)
+
+// Record is one cached entry. It's valid only as long as every stat
+// field covered by the current Mask still matches os.Lstat; callers
+// own that comparison since only they know how Mask bits map to stat
+// fields.
+type Record struct {
+	Algorithm string
+	Mask      string
+	Size      int64
+	Mtime     int64
+	MtimeNsec int64
+	Ctime     int64
+	CtimeNsec int64
+	Mode      uint32
+	UID       uint32
+	GID       uint32
+	Xattr     []byte
+	Sum       []byte
+
+	// Chunked, ChunkBits, ChunkMin, and ChunkMax record the
+	// content-defined chunking settings (if any) a Content record's Sum
+	// was computed under, so toggling --chunked or its parameters
+	// invalidates the cache instead of returning a digest hashed under
+	// different settings.
+	Chunked   bool
+	ChunkBits uint
+	ChunkMin  int
+	ChunkMax  int
+
+	// NameSum and PermSum are two of the three components of a Header
+	// record: the name and sysattr digests that feed a directory
+	// entry's Merkle block. Xattr (above) is the third: the entry's
+	// xattr digest. Content records leave all three unset.
+	NameSum []byte
+	PermSum []byte
+}
+
+// Cache is a concurrency-safe, optionally-persistent store of Records.
+// The zero value is not usable; construct one with Open.
+type Cache struct {
+	mu   sync.Mutex
+	tree *tree
+	log  *log
+}
+
+// Open returns a Cache backed by the append-only log at path. An empty
+// path returns an in-memory-only cache that never persists. Records
+// already in the log are loaded immediately so the first lookup can
+// hit.
+func Open(path string) (*Cache, error) {
+	c := &Cache{tree: newTree()}
+	if path == "" {
+		return c, nil
+	}
+	l, entries, err := openLog(path)
+	if err != nil {
+		return nil, err
+	}
+	c.log = l
+	for _, e := range entries {
+		c.tree = c.tree.insert(e.Key, e.Rec)
+	}
+	return c, nil
+}
+
+// Lookup returns the cached record for path/kind, if any.
+func (c *Cache) Lookup(path string, kind Kind) (*Record, bool) {
+	c.mu.Lock()
+	t := c.tree
+	c.mu.Unlock()
+	return t.get(recordKey(path, kind))
+}
+
+// Insert stores rec for path/kind, replacing any previous record, and
+// appends it to the log if the cache is persistent. The log append
+// happens under the same lock as the tree swap: concurrent callers
+// otherwise race on the log's shared writer, which tree.go's parallel
+// treeNode/hashChildren goroutines do in practice whenever --cache-dir
+// is set.
+func (c *Cache) Insert(path string, kind Kind, rec *Record) error {
+	key := recordKey(path, kind)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tree = c.tree.insert(key, rec)
+	if c.log == nil {
+		return nil
+	}
+	return c.log.append(key, rec)
+}
+
+// Close flushes and closes the persistent log, if any.
+func (c *Cache) Close() error {
+	if c.log == nil {
+		return nil
+	}
+	return c.log.Close()
+}
+
+// workDir is looked up once, rather than per key, for recordKey to
+// resolve relative paths against.
+var workDir, _ = os.Getwd()
+
+// recordKey maps a path and kind to the radix tree key described in
+// the package design: a directory's content record is keyed by its
+// own cleaned absolute path (a relative path is resolved against the
+// working directory) and its header record by that path plus a
+// trailing separator, except the filesystem root, which uses "" for
+// content (since "/" is already taken by its own header) and "/" for
+// header (appending a separator to "/" would otherwise double it up).
+func recordKey(path string, kind Kind) string {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workDir, path)
+	}
+	if kind == Header {
+		if path == "/" {
+			return "/"
+		}
+		return path + "/"
+	}
+	if path == "/" {
+		return ""
+	}
+	return path
+}
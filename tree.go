@@ -0,0 +1,266 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sclevine/sum/sum"
+)
+
+// Tree returns the lazily-hashed root of paths as a single *sum.Node.
+// Stat and directory reads happen eagerly, since they're needed to
+// know the tree's shape at all; only the expensive work (reading file
+// contents, recursing into a Merkle digest) is deferred to Node.Hash,
+// so a caller that only wants to enumerate or filter the tree never
+// pays for it.
+//
+// For a single path the returned node is that path's own tree. For
+// multiple paths, they're grouped under a synthetic, path-less root
+// node combined the same way a directory combines its entries.
+func (s Sum) Tree(paths []string) (*sum.Node, error) {
+	if len(paths) == 1 {
+		return s.treeNode(filepath.Clean(paths[0]), false, nil)
+	}
+
+	children := make([]*sum.Node, len(paths))
+	entries := make([]*Node, len(paths))
+	for i, path := range paths {
+		path = filepath.Clean(path)
+		child, err := s.treeNode(path, false, nil)
+		if err != nil {
+			return nil, err
+		}
+		fi := child.Info()
+		children[i] = child
+		entries[i] = &Node{path, nil, fi.Mode(), getSysProps(fi)}
+	}
+	hashFn := func() ([]byte, error) {
+		if err := hashChildren(children, entries); err != nil {
+			return nil, err
+		}
+		return s.merkle(entries)
+	}
+	// The synthetic root has no path of its own, but still needs a
+	// real os.FileInfo: a caller that calls Info() on it (as any
+	// directory node can be expected to support) would otherwise panic
+	// on a nil interface.
+	return sum.NewNode("", rootDirInfo{}, children, hashFn), nil
+}
+
+// rootDirInfo is the synthetic os.FileInfo for Tree's multi-path root:
+// a directory with no meaningful size, mode bits beyond ModeDir, or
+// mod time, since it doesn't correspond to any real path.
+type rootDirInfo struct{}
+
+func (rootDirInfo) Name() string       { return "" }
+func (rootDirInfo) Size() int64        { return 0 }
+func (rootDirInfo) Mode() os.FileMode  { return os.ModeDir }
+func (rootDirInfo) ModTime() time.Time { return time.Time{} }
+func (rootDirInfo) IsDir() bool        { return true }
+func (rootDirInfo) Sys() interface{}   { return nil }
+
+// TreeSum hashes each of paths via the lazy Tree API, resolving every
+// path's Node.Hash concurrently with the others and returning results
+// as they complete through the same func() (*Node, error) protocol
+// main's output loop already expects.
+func (s Sum) TreeSum(paths []string) func() (*Node, error) {
+	queue := newPQ(len(paths))
+	for i, path := range paths {
+		i, path := i, path
+		go func() {
+			n, err := s.treeSumOne(path)
+			queue.add(i, n, err)
+		}()
+	}
+	return queue.next
+}
+
+func (s Sum) treeSumOne(path string) (*Node, error) {
+	path = filepath.Clean(path)
+	node, err := s.treeNode(path, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := node.Hash()
+	if err != nil {
+		return nil, err
+	}
+	fi := node.Info()
+	return &Node{path, digest, fi.Mode(), getSysProps(fi)}, nil
+}
+
+// treeNode builds a lazily-hashed *sum.Node rooted at path. If cached
+// is non-nil, it's set once the node's digest is computed (or reused
+// from Sum.Cache), reporting whether that came from an unchanged
+// cache entry; a parent directory needs this to decide whether its
+// own cached content digest is still trustworthy, since a directory's
+// own stat doesn't change when a descendant's content does.
+func (s Sum) treeNode(path string, subdir bool, cached *bool) (*sum.Node, error) {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil, pathNewErr("does not exist", path, subdir)
+	}
+	if err != nil {
+		return nil, pathErr("stat", path, subdir, err)
+	}
+	sys := getSysProps(fi)
+
+	if !fi.IsDir() {
+		if digest, ok := s.cacheLookupContent(path, fi, sys); ok {
+			if cached != nil {
+				*cached = true
+			}
+			return sum.NewNode(path, fi, nil, func() ([]byte, error) { return digest, nil }), nil
+		}
+	}
+
+	switch {
+	case fi.IsDir():
+		names, err := readDirUnordered(path)
+		if err != nil {
+			return nil, pathErr("read dir", path, subdir, err)
+		}
+		children := make([]*sum.Node, len(names))
+		entries := make([]*Node, len(names))
+		childCached := make([]bool, len(names))
+		// Stat and readdir each child concurrently, not just its
+		// eventual content hash: with many children, doing this
+		// sequentially serializes a stat-and-readdir phase that should
+		// overlap across siblings.
+		var wg sync.WaitGroup
+		wg.Add(len(names))
+		errC := make(chan error, len(names))
+		for i, name := range names {
+			i, name := i, name
+			go func() {
+				defer wg.Done()
+				childPath := filepath.Join(path, name)
+				child, err := s.treeNode(childPath, true, &childCached[i])
+				if err != nil {
+					errC <- err
+					return
+				}
+				childFi := child.Info()
+				children[i] = child
+				entries[i] = &Node{childPath, nil, childFi.Mode(), getSysProps(childFi)}
+			}()
+		}
+		wg.Wait()
+		close(errC)
+		if err := <-errC; err != nil {
+			return nil, err
+		}
+		hashFn := func() ([]byte, error) {
+			if err := hashChildren(children, entries); err != nil {
+				return nil, err
+			}
+			if allCached(childCached) {
+				if digest, ok := s.cacheLookupContent(path, fi, sys); ok {
+					if cached != nil {
+						*cached = true
+					}
+					return digest, nil
+				}
+			}
+			digest, err := s.merkle(entries)
+			if err != nil {
+				return nil, pathErr("hash", path, subdir, err)
+			}
+			s.cacheStoreContent(path, fi, sys, digest)
+			if cached != nil {
+				*cached = false
+			}
+			return digest, nil
+		}
+		return sum.NewNode(path, fi, children, hashFn), nil
+
+	case fi.Mode().IsRegular() || (!subdir && fi.Mode()&os.ModeSymlink != 0):
+		hashFn := func() ([]byte, error) {
+			lock()
+			defer release()
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, pathErr("open", path, subdir, err)
+			}
+			defer f.Close()
+			var digest []byte
+			if s.Chunk != nil && fi.Mode().IsRegular() {
+				digest, err = s.hashReaderChunked(f, path)
+			} else {
+				digest, err = s.hashReader(f)
+			}
+			if err != nil {
+				return nil, pathErr("hash", path, subdir, err)
+			}
+			s.cacheStoreContent(path, fi, sys, digest)
+			if cached != nil {
+				*cached = false
+			}
+			return digest, nil
+		}
+		return sum.NewNode(path, fi, nil, hashFn), nil
+
+	case fi.Mode()&os.ModeSymlink != 0:
+		hashFn := func() ([]byte, error) {
+			lock()
+			defer release()
+			link, err := os.Readlink(path)
+			if err != nil {
+				return nil, pathErr("read link", path, subdir, err)
+			}
+			digest, err := s.hash([]byte(link))
+			if err != nil {
+				return nil, pathErr("hash", path, subdir, err)
+			}
+			s.cacheStoreContent(path, fi, sys, digest)
+			if cached != nil {
+				*cached = false
+			}
+			return digest, nil
+		}
+		return sum.NewNode(path, fi, nil, hashFn), nil
+	}
+	return nil, pathErr("hash", path, subdir, ErrSpecialFile)
+}
+
+// allCached reports whether every element of cached is true, the
+// condition under which a directory's own cached content digest (keyed
+// only on its own stat) is still safe to reuse.
+func allCached(cached []bool) bool {
+	for _, c := range cached {
+		if !c {
+			return false
+		}
+	}
+	return true
+}
+
+// hashChildren resolves every child's digest into the matching entry,
+// concurrently, so a directory's lazily-computed digest still hashes
+// its subtree in parallel.
+func hashChildren(children []*sum.Node, entries []*Node) error {
+	var wg sync.WaitGroup
+	wg.Add(len(children))
+	errs := make([]error, len(children))
+	for i := range children {
+		i := i
+		go func() {
+			defer wg.Done()
+			digest, err := children[i].Hash()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			entries[i].Sum = digest
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}